@@ -5,6 +5,8 @@
 package main_test
 
 import (
+	"encoding/json"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
@@ -12,22 +14,81 @@ import (
 	"testing"
 )
 
-func TestBasic(t *testing.T) {
-	tdir := t.TempDir()
-
-	// Do a build of . into <tmpdir>/out.exe
+// buildSelf builds . into <tdir>/out.exe and returns the exe path, for
+// tests that need to run pcritical against its own module.
+func buildSelf(t *testing.T, tdir string) string {
+	t.Helper()
 	exe := filepath.Join(tdir, "out.exe")
 	gotoolpath := filepath.Join(runtime.GOROOT(), "bin", "go")
 	cmd := exec.Command(gotoolpath, "build", "-o", exe, ".")
-	//t.Logf("cmd: %+v\n", cmd)
 	if b, err := cmd.CombinedOutput(); err != nil {
 		t.Logf("build: %s\n", b)
 		t.Fatalf("build error: %v", err)
 	}
+	return exe
+}
+
+// jsonNode/jsonEdge/jsonPath mirror the subset of the -jsonout schema
+// (see WriteJSON) these tests check.
+type jsonNode struct {
+	ID         int    `json:"id"`
+	ImportPath string `json:"importpath"`
+	Standard   bool   `json:"standard"`
+	Size       int    `json:"size"`
+	NumFuncs   int    `json:"numfuncs"`
+}
+
+type jsonEdge struct {
+	From   int `json:"from"`
+	To     int `json:"to"`
+	Weight int `json:"weight"`
+}
+
+type jsonPathSegment struct {
+	ID               int `json:"id"`
+	Weight           int `json:"weight"`
+	CumulativeWeight int `json:"cumulativeweight"`
+}
+
+type jsonPath struct {
+	Segments    []jsonPathSegment `json:"segments"`
+	TotalWeight int               `json:"totalweight"`
+}
+
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+	Paths []jsonPath `json:"paths"`
+}
+
+func readJSONGraph(t *testing.T, path string) jsonGraph {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	var jg jsonGraph
+	if err := json.Unmarshal(b, &jg); err != nil {
+		t.Fatalf("unmarshaling %s: %v", path, err)
+	}
+	return jg
+}
+
+func importPaths(jg jsonGraph) map[string]bool {
+	m := make(map[string]bool)
+	for _, n := range jg.Nodes {
+		m[n.ImportPath] = true
+	}
+	return m
+}
+
+func TestBasic(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
 
 	// Run self on self.
 	dotp := filepath.Join(tdir, "out.dot")
-	cmd = exec.Command(exe, "-polyline", "-dotout="+dotp, "-tgt=github.com/thanm/pcritical")
+	cmd := exec.Command(exe, "-polyline", "-dotout="+dotp, "-tgt=github.com/thanm/pcritical")
 	//t.Logf("cmd: %+v\n", cmd)
 	var output string
 	if b, err := cmd.CombinedOutput(); err != nil {
@@ -42,7 +103,7 @@ func TestBasic(t *testing.T) {
 	critpath := []string{}
 	cap := false
 	for _, line := range lines {
-		if line == "Critical path:" {
+		if strings.HasPrefix(line, "Critical path ") {
 			cap = true
 			continue
 		}
@@ -66,3 +127,152 @@ func TestBasic(t *testing.T) {
 		t.Errorf("critpath[last] got %s want %s", cpl, wantlast)
 	}
 }
+
+// TestListModeBulkEquivalence checks that -listmode=bulk produces the
+// same node set as the default -listmode=per-pkg, including for the
+// -tests edges collected along the way (regression for the bulk
+// listmode silently dropping transitive test-only deps).
+func TestListModeBulkEquivalence(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
+
+	run := func(listmode string) jsonGraph {
+		jsonp := filepath.Join(tdir, listmode+".json")
+		cmd := exec.Command(exe, "-nostd", "-tests", "-listmode="+listmode,
+			"-dotout="+filepath.Join(tdir, listmode+".dot"),
+			"-jsonout="+jsonp, "-tgt=github.com/thanm/pcritical")
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("run -listmode=%s: %v\n%s", listmode, err, b)
+		}
+		return readJSONGraph(t, jsonp)
+	}
+
+	perpkg := importPaths(run("per-pkg"))
+	bulk := importPaths(run("bulk"))
+
+	for p := range perpkg {
+		if !bulk[p] {
+			t.Errorf("per-pkg has %s but bulk does not", p)
+		}
+	}
+	for p := range bulk {
+		if !perpkg[p] {
+			t.Errorf("bulk has %s but per-pkg does not", p)
+		}
+	}
+
+	want := "github.com/thanm/grvutils/testutils"
+	if !bulk[want] {
+		t.Errorf("-listmode=bulk -tests: missing transitive test-only dep %s", want)
+	}
+}
+
+// TestTopK checks that -topk produces the requested number of critical
+// paths, ordered by non-increasing total weight.
+func TestTopK(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
+
+	jsonp := filepath.Join(tdir, "topk.json")
+	cmd := exec.Command(exe, "-nostd", "-topk=3",
+		"-dotout="+filepath.Join(tdir, "topk.dot"),
+		"-jsonout="+jsonp, "-tgt=github.com/thanm/pcritical")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run -topk=3: %v\n%s", err, b)
+	}
+	jg := readJSONGraph(t, jsonp)
+
+	if len(jg.Paths) != 3 {
+		t.Fatalf("got %d paths, want 3", len(jg.Paths))
+	}
+	for i := 1; i < len(jg.Paths); i++ {
+		if jg.Paths[i].TotalWeight > jg.Paths[i-1].TotalWeight {
+			t.Errorf("path %d has weight %d > path %d's weight %d, not non-increasing",
+				i, jg.Paths[i].TotalWeight, i-1, jg.Paths[i-1].TotalWeight)
+		}
+	}
+}
+
+// TestJSONOutSchema does a basic sanity check of the -jsonout document:
+// every edge's endpoints and every path segment's id refer to a node
+// that was actually emitted.
+func TestJSONOutSchema(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
+
+	jsonp := filepath.Join(tdir, "schema.json")
+	cmd := exec.Command(exe, "-nostd",
+		"-dotout="+filepath.Join(tdir, "schema.dot"),
+		"-jsonout="+jsonp, "-tgt=github.com/thanm/pcritical")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run: %v\n%s", err, b)
+	}
+	jg := readJSONGraph(t, jsonp)
+
+	if len(jg.Nodes) == 0 {
+		t.Fatal("no nodes in JSON output")
+	}
+	ids := make(map[int]bool)
+	for _, n := range jg.Nodes {
+		ids[n.ID] = true
+	}
+	for _, e := range jg.Edges {
+		if !ids[e.From] {
+			t.Errorf("edge references unknown node id %d as From", e.From)
+		}
+		if !ids[e.To] {
+			t.Errorf("edge references unknown node id %d as To", e.To)
+		}
+	}
+	for _, p := range jg.Paths {
+		for _, seg := range p.Segments {
+			if !ids[seg.ID] {
+				t.Errorf("path segment references unknown node id %d", seg.ID)
+			}
+		}
+	}
+}
+
+// TestCrossTarget checks that -goos/-goarch (cross-target analysis)
+// runs cleanly against a target different from the host's.
+func TestCrossTarget(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
+
+	goarch := "arm64"
+	if runtime.GOARCH == "arm64" {
+		goarch = "amd64"
+	}
+	jsonp := filepath.Join(tdir, "cross.json")
+	cmd := exec.Command(exe, "-nostd", "-goarch="+goarch,
+		"-glcache="+filepath.Join(tdir, "glcache"),
+		"-dotout="+filepath.Join(tdir, "cross.dot"),
+		"-jsonout="+jsonp, "-tgt=github.com/thanm/pcritical")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run -goarch=%s: %v\n%s", goarch, err, b)
+	}
+	jg := readJSONGraph(t, jsonp)
+	if len(jg.Nodes) == 0 {
+		t.Fatal("no nodes in JSON output for cross-target run")
+	}
+}
+
+// TestWeightsMeasured checks that -weights=measured runs cleanly and
+// produces a non-zero critical path.
+func TestWeightsMeasured(t *testing.T) {
+	tdir := t.TempDir()
+	exe := buildSelf(t, tdir)
+
+	jsonp := filepath.Join(tdir, "measured.json")
+	cmd := exec.Command(exe, "-nostd", "-weights=measured",
+		"-glcache="+filepath.Join(tdir, "glcache"),
+		"-dotout="+filepath.Join(tdir, "measured.dot"),
+		"-jsonout="+jsonp, "-tgt=github.com/thanm/pcritical")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run -weights=measured: %v\n%s", err, b)
+	}
+	jg := readJSONGraph(t, jsonp)
+	if len(jg.Paths) == 0 || jg.Paths[0].TotalWeight <= 0 {
+		t.Fatalf("expected a non-zero critical path, got paths=%+v", jg.Paths)
+	}
+}
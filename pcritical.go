@@ -5,6 +5,8 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -17,6 +19,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/thanm/gocmdcache"
 	"github.com/thanm/grvutils/zgr"
@@ -26,7 +29,6 @@ import (
 // - run "go list" calculations for deps in parallel
 // - add module path awareness (e.g. don't emit nodes not in main module)
 // - add package staleness check
-// - add build timings (might need to defeat build cache)
 
 var verbflag = flag.Int("v", 0, "Verbose trace output level")
 var glcacheflag = flag.String("glcache", "/tmp/.glcache", "cache dir for 'go list' invocations")
@@ -35,6 +37,15 @@ var dotoutflag = flag.String("dotout", "tmp.dot", "DOT file to emit")
 var nostdflag = flag.Bool("nostd", false, "Ignore stdlib package deps")
 var inunsflag = flag.Bool("include-unsafe", false, "include \"unsafe\" package")
 var polylineflag = flag.Bool("polyline", false, "Add splines=polyline attribute to generated DOT graph")
+var listmodeflag = flag.String("listmode", "per-pkg", "graph construction mode: 'bulk' (single 'go list -deps -json' call) or 'per-pkg' (recursive per-dependency calls)")
+var topkflag = flag.Int("topk", 1, "number of top critical paths to extract and display")
+var weightsflag = flag.String("weights", "size", "edge weight source: 'size' (compiled archive size), 'actiongraph' (single 'go build -debug-actiongraph' run), or 'measured' (per-package 'go build -a' timing)")
+var testsflag = flag.Bool("tests", false, "also include TestImports/XTestImports deps, as 'go test' would build them")
+var testsincritpathflag = flag.Bool("tests-in-critpath", true, "consider test-only edges when computing critical paths (has no effect unless -tests is set)")
+var jsonoutflag = flag.String("jsonout", "", "if set, write the graph and critical paths as JSON to this path")
+var goosflag = flag.String("goos", "", "target GOOS for cross-target analysis (empty means host GOOS)")
+var goarchflag = flag.String("goarch", "", "target GOARCH for cross-target analysis (empty means host GOARCH)")
+var tagsflag = flag.String("tags", "", "build tags to pass to 'go list'/'go build'")
 
 // hashes for use with disk cache
 var goroothash string
@@ -43,6 +54,15 @@ var repohash string
 // cache
 var gcache *gocmdcache.Cache
 
+// crossListCache memoizes goListUncached for the lifetime of the
+// process. gcache's on-disk cache has no notion of GOOS/GOARCH/tags, so
+// cross-target runs bypass it entirely (see goList) and would otherwise
+// re-fork "go list" once per importer of a shared dependency - the exact
+// overhead -listmode=bulk was written to eliminate - on every cross-
+// target invocation, the common case rather than an edge case.
+var crossListCacheMu sync.Mutex
+var crossListCache = make(map[string]*gocmdcache.Pkg)
+
 func glo(repo string, soft bool) string {
 	if soft {
 		// Don't fail if no .git, just return path.
@@ -61,9 +81,98 @@ func glo(repo string, soft bool) string {
 	return strings.TrimSpace(string(out))
 }
 
+// pkgTestInfo mirrors the subset of "go list -json -test" output this
+// module needs beyond what gocmdcache.Pkg already models: the deps
+// pulled in by _test.go files in the package itself (TestImports) and
+// by an external "pkg_test" package (XTestImports).
+type pkgTestInfo struct {
+	ImportPath   string
+	TestImports  []string
+	XTestImports []string
+}
+
+// goListTestUncached runs "go list -json -test <tgt>" and returns the
+// entry describing tgt's own test dependencies (the invocation also
+// emits synthetic entries for the woven "test variant" and ".test"
+// binary packages, which are skipped here).
+func goListTestUncached(tgt string) (*pkgTestInfo, error) {
+	args := []string{"list", "-json", "-test"}
+	if *tagsflag != "" {
+		args = append(args, "-tags="+*tagsflag)
+	}
+	args = append(args, tgt)
+	cmd := exec.Command("go", args...)
+	cmd.Env = crossEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -json -test %s: %v", tgt, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pti pkgTestInfo
+		if err := dec.Decode(&pti); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("go list -json -test %s: decode: %v", tgt, err)
+		}
+		if pti.ImportPath == tgt {
+			return &pti, nil
+		}
+	}
+	return nil, fmt.Errorf("go list -json -test %s: no entry for %s", tgt, tgt)
+}
+
+// crossEnv returns the environment to use for 'go list'/'go build'
+// subprocesses, overriding GOOS/GOARCH when -goos/-goarch are set so
+// that the graph reflects the requested target rather than the host.
+func crossEnv() []string {
+	env := os.Environ()
+	if *goosflag != "" {
+		env = append(env, "GOOS="+*goosflag)
+	}
+	if *goarchflag != "" {
+		env = append(env, "GOARCH="+*goarchflag)
+	}
+	return env
+}
+
+// crossTarget reports whether any of -goos/-goarch/-tags was set, i.e.
+// whether this run is analyzing something other than the host's default
+// build.
+func crossTarget() bool {
+	return *goosflag != "" || *goarchflag != "" || *tagsflag != ""
+}
+
+// targetKey identifies the cross-target configuration (if any) so that
+// cached results for different goos/goarch/tags combinations don't
+// collide with each other or with the host-default cache.
+func targetKey() string {
+	return fmt.Sprintf("goos=%s,goarch=%s,tags=%s", *goosflag, *goarchflag, *tagsflag)
+}
+
+// cacheDir returns the on-disk directory gcache and the build-time
+// cache should use for the current target: a subdirectory of -glcache
+// keyed by targetKey(). gcache's checkValid() wipes its whole root
+// directory on a repohash/goroothash mismatch, so every target -
+// including the host-default one - needs its own subdirectory; handing
+// gcache -glcache itself as the root for the host-default target would
+// make its checkValid() wipe out every other target's subdirectory
+// alongside it, since they all live under -glcache.
+func cacheDir() string {
+	h := sha256.Sum256([]byte(targetKey()))
+	return filepath.Join(*glcacheflag, fmt.Sprintf("tgt-%x", h))
+}
+
 func goListUncached(tgt string) (*gocmdcache.Pkg, error) {
 	// run "go list"
-	cmd := exec.Command("go", "list", "-json", tgt)
+	args := []string{"list", "-json"}
+	if *tagsflag != "" {
+		args = append(args, "-tags="+*tagsflag)
+	}
+	args = append(args, tgt)
+	cmd := exec.Command("go", args...)
+	cmd.Env = crossEnv()
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("go list -json %s: %v", tgt, err)
@@ -76,7 +185,27 @@ func goListUncached(tgt string) (*gocmdcache.Pkg, error) {
 	return &pkg, nil
 }
 
+// goList looks up dir's Pkg info, going through gcache's on-disk cache
+// for the common (host-target) case. gcache has no notion of
+// GOOS/GOARCH/tags, so cross-target runs bypass it and shell out via
+// goListUncached instead, memoized in crossListCache for the run.
 func goList(dir string) (*gocmdcache.Pkg, error) {
+	if crossTarget() {
+		crossListCacheMu.Lock()
+		pk, ok := crossListCache[dir]
+		crossListCacheMu.Unlock()
+		if ok {
+			return pk, nil
+		}
+		pk, err := goListUncached(dir)
+		if err != nil {
+			return nil, err
+		}
+		crossListCacheMu.Lock()
+		crossListCache[dir] = pk
+		crossListCacheMu.Unlock()
+		return pk, nil
+	}
 	return gcache.GoList(dir)
 }
 
@@ -85,6 +214,150 @@ func (g *pgraph) nidPkgSize(nid string) (gocmdcache.PkgInfo, error) {
 	pkg := nlab[1 : len(nlab)-1]
 	return gcache.PkgSize(pkg)
 }
+
+// nidWeight returns the weight to assign to edges landing on nid,
+// selected by -weights: compiled archive size by default, or a measured
+// build duration (in ms) when -weights is "actiongraph" or "measured".
+func (g *pgraph) nidWeight(nid string) (int, error) {
+	if *weightsflag == "size" {
+		pi, err := g.nidPkgSize(nid)
+		if err != nil {
+			return 0, err
+		}
+		return pi.Size, nil
+	}
+	nlab := g.LookupNode(nid).Label()
+	pkg := nlab[1 : len(nlab)-1]
+	wt, ok := g.buildtimes[pkg]
+	if !ok {
+		// A package can fail to build in isolation (cgo, platform build
+		// tags, ...) even though the overall graph built fine; fall back
+		// to its compiled size rather than aborting the whole run, to
+		// match the non-fatal warning computeEdgeWeights already logged
+		// when the timing/actiongraph entry for pkg came up missing.
+		verb(1, "warning: no %s timing available for %s, falling back to size", *weightsflag, pkg)
+		pi, err := g.nidPkgSize(nid)
+		if err != nil {
+			return 0, err
+		}
+		return pi.Size, nil
+	}
+	return wt, nil
+}
+
+// actiongraphAction is the subset of the "go build -debug-actiongraph"
+// JSON action record this module cares about.
+type actiongraphAction struct {
+	Mode      string
+	Package   string
+	TimeStart time.Time
+	TimeDone  time.Time
+}
+
+// actionGraphTimings runs "go build -a -debug-actiongraph" once for tgt
+// and returns the measured wall-clock build duration (in ms) of each
+// package's "build" action.
+func actionGraphTimings(tgt string) (map[string]int, error) {
+	agf, err := os.CreateTemp("", "pcritical-actiongraph-*.json")
+	if err != nil {
+		return nil, err
+	}
+	agpath := agf.Name()
+	agf.Close()
+	defer os.Remove(agpath)
+
+	args := []string{"build", "-a", "-o", os.DevNull, "-debug-actiongraph=" + agpath}
+	if *tagsflag != "" {
+		args = append(args, "-tags="+*tagsflag)
+	}
+	args = append(args, tgt)
+	cmd := exec.Command("go", args...)
+	cmd.Env = crossEnv()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("go build -debug-actiongraph %s: %v: %s", tgt, err, out)
+	}
+
+	data, err := os.ReadFile(agpath)
+	if err != nil {
+		return nil, err
+	}
+	var actions []actiongraphAction
+	if err := json.Unmarshal(data, &actions); err != nil {
+		return nil, fmt.Errorf("unmarshal actiongraph output: %v", err)
+	}
+	timings := make(map[string]int)
+	for _, a := range actions {
+		if a.Mode != "build" || a.Package == "" {
+			continue
+		}
+		timings[a.Package] = int(a.TimeDone.Sub(a.TimeStart).Milliseconds())
+	}
+	return timings, nil
+}
+
+// buildTimeCachePath returns the on-disk location for pkg's measured
+// build timing. gocmdcache.Cache only exposes a write-only WriteCache,
+// with no matching read-back call, so measured timings are cached in
+// their own small file under cacheDir() instead, keyed by repo/goroot/
+// pkg so stale entries can't be misread as current.
+func buildTimeCachePath(pkg string) string {
+	key := repohash + "|" + goroothash + "|" + pkg
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir(), fmt.Sprintf("buildtime-%x", h))
+}
+
+func readCachedBuildTime(pkg string) (int, bool) {
+	data, err := os.ReadFile(buildTimeCachePath(pkg))
+	if err != nil {
+		return 0, false
+	}
+	var ms int
+	if _, err := fmt.Sscanf(string(data), "%d", &ms); err != nil {
+		return 0, false
+	}
+	return ms, true
+}
+
+func writeCachedBuildTime(pkg string, ms int) {
+	if err := os.MkdirAll(cacheDir(), 0755); err != nil {
+		verb(1, "warning: failed to create %s: %v", cacheDir(), err)
+		return
+	}
+	if err := os.WriteFile(buildTimeCachePath(pkg), []byte(fmt.Sprintf("%d", ms)), 0644); err != nil {
+		verb(1, "warning: failed to cache build time for %s: %v", pkg, err)
+	}
+}
+
+// measuredTiming builds pkg in isolation with a scratch GOCACHE (so the
+// build cache can't mask the true cost) and returns the wall-clock
+// duration in ms, caching the result on disk so repeat runs are fast.
+func measuredTiming(pkg string) (int, error) {
+	if ms, ok := readCachedBuildTime(pkg); ok {
+		return ms, nil
+	}
+
+	scratch, err := os.MkdirTemp("", "pcritical-gocache-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(scratch)
+
+	args := []string{"build", "-a", "-o", os.DevNull}
+	if *tagsflag != "" {
+		args = append(args, "-tags="+*tagsflag)
+	}
+	args = append(args, pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Env = append(crossEnv(), "GOCACHE="+scratch)
+	start := time.Now()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("go build -a %s: %v: %s", pkg, err, out)
+	}
+	ms := int(time.Since(start).Milliseconds())
+
+	writeCachedBuildTime(pkg, ms)
+	return ms, nil
+}
 func goRoot() (string, error) {
 	cmd := exec.Command("go", "env", "GOROOT")
 	out, err := cmd.Output()
@@ -103,37 +376,68 @@ func nodeAttr(n string) map[string]string {
 
 type pgraph struct {
 	*zgr.Graph
-	nodes  map[string]int
-	tslist []string
-	goroot string
+	nodes      map[string]int
+	tslist     []string
+	goroot     string
+	buildtimes map[string]int  // import path -> measured/actiongraph build duration in ms, populated when -weights != "size"
+	testEdges  map[string]bool // edgeKey(src,sink) -> true for edges added only because of -tests
+	standard   map[string]bool // import path -> whether it's part of the standard library
 }
 
-func tsvisit(g *pgraph, snid string, visited map[string]bool) {
+// tsvisit does a standard DFS-based topological-sort visit of snid,
+// skipping masked edges so the order it produces is valid for the same
+// masked subgraph pathTo walks. onstack tracks the nodes on the current
+// recursion stack (as opposed to visited, which never unmarks a node)
+// so that a back-edge - which would otherwise make the resulting order
+// silently invalid rather than merely re-visit a node - is caught as a
+// cycle instead.
+func tsvisit(g *pgraph, snid string, visited, onstack map[string]bool, masked map[string]bool) error {
 	if visited[snid] {
-		return
+		return nil
 	}
 	visited[snid] = true
+	onstack[snid] = true
 	n := g.LookupNode(snid)
 	edges := g.GetEdges(n)
 	for _, e := range edges {
 		edge := g.GetEdge(e)
-		_, sink := g.GetEndpoints(edge)
+		src, sink := g.GetEndpoints(edge)
 		sn := g.GetNode(sink)
-		tsvisit(g, sn.Id(), visited)
+		if masked[edgeKey(g.GetNode(src).Id(), sn.Id())] {
+			continue
+		}
+		if onstack[sn.Id()] {
+			return fmt.Errorf("cycle detected in dependency graph at %s -> %s; "+
+				"-tests edges can introduce cycles, consider -tests-in-critpath=false",
+				g.LookupNode(snid).Label(), sn.Label())
+		}
+		if err := tsvisit(g, sn.Id(), visited, onstack, masked); err != nil {
+			return err
+		}
 	}
+	onstack[snid] = false
 	g.tslist = append(g.tslist, snid)
+	return nil
 }
 
-func topsort(g *pgraph, root string) []string {
+// topsort returns a topological ordering of the nodes reachable from
+// root, over the subgraph with masked edges removed (the same masked
+// set markCriticalPaths/pathTo operate over), so the two stay
+// consistent; see tsvisit for cycle handling.
+func topsort(g *pgraph, root string, masked map[string]bool) ([]string, error) {
 	visited := make(map[string]bool)
-	tsvisit(g, root, visited)
+	onstack := make(map[string]bool)
+	if err := tsvisit(g, root, visited, onstack, masked); err != nil {
+		g.tslist = nil
+		return nil, err
+	}
 	n := len(g.tslist)
 	final := make([]string, n)
 	for k := range g.tslist {
 		final[n-k-1] = g.tslist[k]
 	}
 	g.tslist = nil
-	return final
+	return final, nil
 }
 
 func (g *pgraph) nid(n string) int {
@@ -163,6 +467,7 @@ func populateNode(tgt string, g *pgraph) (string, error) {
 	if err != nil {
 		return snid, err
 	}
+	g.standard[tgt] = pk.Standard
 	pskip := func(dep string) bool {
 		return (!*inunsflag && dep == "unsafe") ||
 			dep == "C"
@@ -209,33 +514,219 @@ func populateNode(tgt string, g *pgraph) (string, error) {
 		}
 		g.AddEdge(snid, g.snid(dep), nil)
 	}
+
+	if *testsflag {
+		if err := g.addTestEdges(tgt, snid, pskip); err != nil {
+			return snid, err
+		}
+	}
+
 	return snid, nil
 }
 
-func (g *pgraph) computeEdgeWeights(rootnid string) error {
+// addTestEdges pulls in tgt's TestImports/XTestImports (the deps a
+// `go test` build of tgt needs beyond its ordinary Imports) and wires
+// them into the graph as dashed, blue, test-only edges.
+func (g *pgraph) addTestEdges(tgt, snid string, pskip func(string) bool) error {
+	pti, err := goListTestUncached(tgt)
+	if err != nil {
+		return err
+	}
+	testAttrs := func() map[string]string {
+		return map[string]string{"style": "dashed", "color": "blue"}
+	}
+	for _, dep := range append(append([]string{}, pti.TestImports...), pti.XTestImports...) {
+		if pskip(dep) {
+			continue
+		}
+		if dep == tgt {
+			// XTestImports of an external test package commonly includes
+			// the package under test itself; there's already a node for it.
+			continue
+		}
+		pk, err := goList(dep)
+		if err != nil {
+			return err
+		}
+		if *nostdflag && pk.Standard {
+			continue
+		}
+		if _, ok := g.nodes[dep]; !ok {
+			if _, err := populateNode(dep, g); err != nil {
+				return err
+			}
+		}
+		dsnid := g.snid(dep)
+		g.AddEdge(snid, dsnid, testAttrs())
+		g.testEdges[edgeKey(snid, dsnid)] = true
+	}
+	return nil
+}
+
+// goListDepsBulk runs "go list -e -deps -json <tgt>" exactly once and
+// streams the resulting sequence of JSON-encoded Pkg records back as a
+// slice, in the order the tool emitted them (the target itself followed
+// by its transitive dependency closure). This avoids the process-fork
+// overhead of issuing one "go list" invocation per dependency.
+func goListDepsBulk(tgt string) ([]*gocmdcache.Pkg, error) {
+	args := []string{"list", "-e", "-deps", "-json"}
+	if *tagsflag != "" {
+		args = append(args, "-tags="+*tagsflag)
+	}
+	args = append(args, tgt)
+	cmd := exec.Command("go", args...)
+	cmd.Env = crossEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -e -deps -json %s: %v", tgt, err)
+	}
+	var pkgs []*gocmdcache.Pkg
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pk gocmdcache.Pkg
+		if err := dec.Decode(&pk); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("go list -e -deps -json %s: decode: %v", tgt, err)
+		}
+		pkgs = append(pkgs, &pk)
+	}
+	return pkgs, nil
+}
 
-	verb(1, "starting pkg size computation root=%s", rootnid)
+// populateGraphBulk builds the dependency graph for tgt from a single
+// "go list -deps -json" invocation rather than recursing one dependency
+// at a time (see populateNode). The per-package gcache is left untouched
+// here and continues to be used for PkgSize lookups downstream. -tests
+// edges are collected for every package in the closure, same as
+// populateNode does one node at a time, by falling back to a per-package
+// "go list -json -test" call (addTestEdges) for each - the bulk call has
+// no equivalent of "list every package's test imports in one shot".
+func populateGraphBulk(tgt string, g *pgraph) (string, error) {
+	pkgs, err := goListDepsBulk(tgt)
+	if err != nil {
+		return "", err
+	}
+	pskip := func(dep string) bool {
+		return (!*inunsflag && dep == "unsafe") || dep == "C"
+	}
+
+	// First pass: create a node for every package in the closure
+	// (modulo -nostd / -include-unsafe / "C" filtering).
+	for _, pk := range pkgs {
+		if pskip(pk.ImportPath) {
+			continue
+		}
+		if *nostdflag && pk.Standard && pk.ImportPath != tgt {
+			continue
+		}
+		if _, ok := g.nodes[pk.ImportPath]; ok {
+			continue
+		}
+		nid := len(g.nodes)
+		g.nodes[pk.ImportPath] = nid
+		g.standard[pk.ImportPath] = pk.Standard
+		snid := g.snid(pk.ImportPath)
+		if err := g.MakeNode(snid, nodeAttr(pk.ImportPath)); err != nil {
+			return "", err
+		}
+	}
+
+	// Second pass: wire up edges from each package's direct imports,
+	// now that every node that will ever exist has been created.
+	for _, pk := range pkgs {
+		if _, ok := g.nodes[pk.ImportPath]; !ok {
+			continue
+		}
+		snid := g.snid(pk.ImportPath)
+		for _, dep := range pk.Imports {
+			if pskip(dep) {
+				continue
+			}
+			if _, ok := g.nodes[dep]; !ok {
+				// Filtered out above (e.g. -nostd), skip the edge too.
+				continue
+			}
+			g.AddEdge(snid, g.snid(dep), nil)
+		}
+	}
+
+	if *testsflag {
+		// Iterate the closure gathered above, not g.nodes, so that
+		// packages addTestEdges itself adds along the way (test-only
+		// deps reachable from no ordinary import) don't get test-edge
+		// collection run on them twice.
+		for _, pk := range pkgs {
+			if _, ok := g.nodes[pk.ImportPath]; !ok {
+				continue
+			}
+			if err := g.addTestEdges(pk.ImportPath, g.snid(pk.ImportPath), pskip); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return g.snid(tgt), nil
+}
+
+func (g *pgraph) computeEdgeWeights(rootnid string, target string) error {
+
+	verb(1, "starting edge weight computation root=%s weights=%s", rootnid, *weightsflag)
 	verb(2, "g.nodes: %+v", g.nodes)
 
-	// Compute package sizes.
-	var wg sync.WaitGroup
-	wg.Add(len(g.nodes))
-	sema := make(chan struct{}, runtime.GOMAXPROCS(0)/2)
-	for pk := range g.nodes {
-		go func(pk string) {
-			sema <- struct{}{}
-			defer func() {
-				<-sema
-				wg.Done()
-			}()
-			gcache.PkgSize(pk)
-		}(pk)
+	switch *weightsflag {
+	case "actiongraph":
+		timings, err := actionGraphTimings(target)
+		if err != nil {
+			return fmt.Errorf("actiongraph timing: %v", err)
+		}
+		g.buildtimes = timings
+	case "measured":
+		g.buildtimes = make(map[string]int)
+		var wg sync.WaitGroup
+		wg.Add(len(g.nodes))
+		sema := make(chan struct{}, runtime.GOMAXPROCS(0)/2)
+		var mu sync.Mutex
+		for pk := range g.nodes {
+			go func(pk string) {
+				sema <- struct{}{}
+				defer func() {
+					<-sema
+					wg.Done()
+				}()
+				ms, err := measuredTiming(pk)
+				if err != nil {
+					verb(1, "warning: measuredTiming(%s): %v", pk, err)
+					return
+				}
+				mu.Lock()
+				g.buildtimes[pk] = ms
+				mu.Unlock()
+			}(pk)
+		}
+		wg.Wait()
+	default:
+		// Compute package sizes.
+		var wg sync.WaitGroup
+		wg.Add(len(g.nodes))
+		sema := make(chan struct{}, runtime.GOMAXPROCS(0)/2)
+		for pk := range g.nodes {
+			go func(pk string) {
+				sema <- struct{}{}
+				defer func() {
+					<-sema
+					wg.Done()
+				}()
+				gcache.PkgSize(pk)
+			}(pk)
+		}
+		wg.Wait()
 	}
-	wg.Wait()
 
-	verb(1, "finished pkg size computation, applying edge weights")
+	verb(1, "finished weight computation, applying edge weights")
 
-	// Now use sizes for edge weights.
+	// Now apply the selected weight source to every edge.
 	for pk := range g.nodes {
 		nid := g.snid(pk)
 		n := g.LookupNode(nid)
@@ -248,11 +739,11 @@ func (g *pgraph) computeEdgeWeights(rootnid string) error {
 			srcnode := g.GetNode(src)
 			verb(2, "compute weight for %s->%s p=%s",
 				srcnode.Id(), sinknode.Id(), sinknode.Label())
-			pi, err := g.nidPkgSize(sinknode.Id())
+			wt, err := g.nidWeight(sinknode.Id())
 			if err != nil {
-				return fmt.Errorf("bad size calc: %v", err)
+				return fmt.Errorf("bad weight calc: %v", err)
 			}
-			ws := fmt.Sprintf("%d", pi.Size)
+			ws := fmt.Sprintf("%d", wt)
 			attrs := map[string]string{
 				"label": ws,
 			}
@@ -272,30 +763,153 @@ func (g *pgraph) EdgeWeight(e *zgr.Edge) (int, error) {
 	return wt, nil
 }
 
+// jsonNode is the machine-readable description of one graph node.
+type jsonNode struct {
+	ID         int    `json:"id"`
+	ImportPath string `json:"importpath"`
+	Standard   bool   `json:"standard"`
+	Size       int    `json:"size"`
+	NumFuncs   int    `json:"numfuncs"`
+}
+
+// jsonEdge is the machine-readable description of one graph edge.
+type jsonEdge struct {
+	From   int `json:"from"`
+	To     int `json:"to"`
+	Weight int `json:"weight"`
+}
+
+// jsonPathSegment is one hop of a critical path in the JSON output.
+type jsonPathSegment struct {
+	ID               int `json:"id"`
+	Weight           int `json:"weight"`
+	CumulativeWeight int `json:"cumulativeweight"`
+}
+
+// jsonPath is a single critical path (one of the -topk) in the JSON output.
+type jsonPath struct {
+	Segments    []jsonPathSegment `json:"segments"`
+	TotalWeight int               `json:"totalweight"`
+}
+
+// jsonGraph is the top-level document written by WriteJSON.
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+	Paths []jsonPath `json:"paths"`
+}
+
+// WriteJSON emits a stable JSON document describing the subset of the
+// graph reachable via included, plus the K critical paths already
+// extracted by markCriticalPaths, so downstream tooling (dashboards,
+// regression bots) can consume pcritical output without parsing DOT or
+// the human-readable "Critical path:" text.
+func (g *pgraph) WriteJSON(w io.Writer, included map[string]bool, paths [][]pathsegment) error {
+	var jg jsonGraph
+
+	ipaths := make([]string, 0, len(g.nodes))
+	for ip := range g.nodes {
+		ipaths = append(ipaths, ip)
+	}
+	sort.Strings(ipaths)
+
+	for _, ip := range ipaths {
+		snid := g.snid(ip)
+		if !included[snid] {
+			continue
+		}
+		pi, err := g.nidPkgSize(snid)
+		if err != nil {
+			return err
+		}
+		jg.Nodes = append(jg.Nodes, jsonNode{
+			ID:         g.nodes[ip],
+			ImportPath: ip,
+			Standard:   g.standard[ip],
+			Size:       pi.Size,
+			NumFuncs:   pi.NumFuncs,
+		})
+
+		n := g.LookupNode(snid)
+		for _, e := range g.GetEdges(n) {
+			edge := g.GetEdge(e)
+			_, sink := g.GetEndpoints(edge)
+			sinknode := g.GetNode(sink)
+			if !included[sinknode.Id()] {
+				continue
+			}
+			wt, err := g.EdgeWeight(edge)
+			if err != nil {
+				return err
+			}
+			sinklab := sinknode.Label()
+			sinkpath := sinklab[1 : len(sinklab)-1]
+			jg.Edges = append(jg.Edges, jsonEdge{
+				From:   g.nodes[ip],
+				To:     g.nodes[sinkpath],
+				Weight: wt,
+			})
+		}
+	}
+
+	for _, cp := range paths {
+		jp := jsonPath{}
+		var cum int
+		for _, seg := range cp {
+			cum += seg.wt
+			ipath := seg.pkg[1 : len(seg.pkg)-1]
+			jp.Segments = append(jp.Segments, jsonPathSegment{
+				ID:               g.nodes[ipath],
+				Weight:           seg.wt,
+				CumulativeWeight: cum,
+			})
+		}
+		jp.TotalWeight = cum
+		jg.Paths = append(jg.Paths, jp)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&jg)
+}
+
 type pathsegment struct {
 	nid string
 	pkg string
 	wt  int
 }
 
-func traceCritical(g *pgraph, rootnid string, nodes []string, included map[string]bool, pathto map[string]int) error {
-	// paint the critical path starting at root
+// critpathColors cycles through distinct DOT colors for each of the top-K
+// critical paths so they stay visually distinguishable in the rendered
+// graph; it repeats if -topk asks for more paths than there are colors.
+var critpathColors = []string{"red", "orange", "purple", "deeppink", "brown", "darkgreen"}
+
+func edgeKey(srcnid, sinknid string) string {
+	return srcnid + "->" + sinknid
+}
+
+// traceCritical traces a single greedy longest path from rootnid to a
+// sink, using pathto (as computed by pathToSinks over whatever edges
+// aren't already in masked). idx/total identify this path's position
+// among the -topk paths being extracted, and select its paint color.
+// The returned segments let the caller mask the path's interior edges
+// before recomputing pathto for the next iteration.
+func traceCritical(g *pgraph, rootnid string, included map[string]bool, pathto map[string]int, masked map[string]bool, idx, k, rootTotal int) ([]pathsegment, int, error) {
 	included[rootnid] = true
 	cp := []pathsegment{
-		pathsegment{
+		{
 			nid: rootnid,
 			pkg: g.LookupNode(rootnid).Label(),
 			wt:  0,
 		}}
+	color := critpathColors[(idx-1)%len(critpathColors)]
 	cur := rootnid
+	visited := map[string]bool{rootnid: true}
 	for {
 		included[cur] = true
-		// Look at out-edges.
+		// Look at out-edges, ignoring any already claimed by an earlier path.
 		n := g.LookupNode(cur)
 		edges := g.GetEdges(n)
-		if len(edges) == 0 {
-			break
-		}
 		var bestsucc string
 		var bestpt int
 		var bestwt int
@@ -304,23 +918,33 @@ func traceCritical(g *pgraph, rootnid string, nodes []string, included map[strin
 			edge := g.GetEdge(e)
 			_, sink := g.GetEndpoints(edge)
 			sinknid := g.GetNode(sink).Id()
+			if masked[edgeKey(n.Id(), sinknid)] {
+				continue
+			}
+			if visited[sinknid] {
+				// -tests edges can introduce a cycle (a dependency's test
+				// imports reaching back to an ancestor); skip revisiting a
+				// node already on this path rather than looping forever.
+				continue
+			}
 			sinkpt := pathto[sinknid]
 			wt, werr := g.EdgeWeight(edge)
 			if werr != nil {
-				return werr
+				return nil, 0, werr
 			}
-			if bestpt < sinkpt {
+			if bestsucc == "" || bestpt < sinkpt {
 				bestpt = sinkpt
 				bestsucc = sinknid
 				bestwt = wt
 				attrs = g.GetEdgeAttrs(edge)
 			}
 		}
-		if bestpt == 0 {
-			panic("unexpected")
+		if bestsucc == "" {
+			// No unclaimed out-edges left; this path ends here.
+			break
 		}
 		// paint edge
-		attrs["color"] = "red"
+		attrs["color"] = color
 		g.SetEdgeAttrs(n.Id(), bestsucc, attrs)
 		// add segment
 		ps := pathsegment{
@@ -330,27 +954,35 @@ func traceCritical(g *pgraph, rootnid string, nodes []string, included map[strin
 		}
 		cp = append(cp, ps)
 		cur = g.LookupNode(bestsucc).Id()
+		visited[cur] = true
 	}
 
 	var sb strings.Builder
 	if err := writeCP(&sb, cp, g); err != nil {
-		return err
+		return nil, 0, err
 	}
 	cps := sb.String()
 
-	// Write CP to cache
+	// Write CP to cache, one key per path so earlier ones aren't clobbered.
 	root := cp[0].pkg
 	troot := root[1 : len(root)-1]
-	if err := gcache.WriteCache(troot, "cpath", []byte(cps)); err != nil {
-
-		return err
+	if err := gcache.WriteCache(troot, fmt.Sprintf("cpath.%d", idx), []byte(cps)); err != nil {
+		return nil, 0, err
 	}
 
-	// Also emit CP to stdout.
-	fmt.Printf("\nCritical path:\n%s\n", cps)
+	// Also emit CP to stdout, including this path's weight as a
+	// percentage of the root (first/longest) critical path's weight.
+	var pathwt int
+	for _, seg := range cp {
+		pathwt += seg.wt
+	}
+	pct := 100.0
+	if idx > 1 && rootTotal > 0 {
+		pct = float64(pathwt) * 100.0 / float64(rootTotal)
+	}
+	fmt.Printf("\nCritical path %d/%d (total weight %d, %.1f%% of root):\n%s\n", idx, k, pathwt, pct, cps)
 
-	// Done
-	return nil
+	return cp, pathwt, nil
 }
 
 func writeCP(w io.Writer, cp []pathsegment, g *pgraph) error {
@@ -361,30 +993,24 @@ func writeCP(w io.Writer, cp []pathsegment, g *pgraph) error {
 			return err
 		}
 		if _, err := fmt.Fprintf(w, "%s [weight:%d nfuncs:%d]\n",
-			seg.pkg, pi.Size, pi.NumFuncs); err != nil {
+			seg.pkg, seg.wt, pi.NumFuncs); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// markCriticalPaths picks out N critical paths in the graph, prints them
-// out, and updates the graph edge attributes. This version uses
-// weighted edges, where the weight from X->Y is considered to be the
-// estimated build time of Y.
-func markCriticalPaths(g *pgraph, nid string, included map[string]bool) error {
-	listing := topsort(g, nid)
-
-	verb(2, "topsorted listing: %+v", listing)
-
+// pathTo computes, for every node reachable into nid (i.e. every node in
+// listing), the maximum-weight path from that node down to a sink, over
+// the subgraph with masked edges removed.
+func pathTo(g *pgraph, listing []string, masked map[string]bool) (map[string]int, error) {
 	pathto := make(map[string]int)
 	for _, nid := range listing {
-		var err error
-		pi, err := g.nidPkgSize(nid)
+		wt, err := g.nidWeight(nid)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		pathto[nid] = pi.Size
+		pathto[nid] = wt
 	}
 	for k := range listing {
 		nid := listing[len(listing)-k-1]
@@ -397,13 +1023,15 @@ func markCriticalPaths(g *pgraph, nid string, included map[string]bool) error {
 			src, _ := g.GetEndpoints(edge)
 			srcnode := g.GetNode(src)
 			srcnid := srcnode.Id()
+			if masked[edgeKey(srcnid, nid)] {
+				continue
+			}
 			verb(2, "consider edge %s -> %s",
 				g.GetNode(src).Label(), n.Label())
-			pi, err := g.nidPkgSize(srcnid)
+			srcwt, err := g.nidWeight(srcnid)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			srcwt := pi.Size
 			npt := toval + srcwt
 			if pathto[srcnid] < npt {
 				verb(2, "update pathto[%s] to %d (edge to %s)",
@@ -412,35 +1040,85 @@ func markCriticalPaths(g *pgraph, nid string, included map[string]bool) error {
 			}
 		}
 	}
+	return pathto, nil
+}
 
-	// Sort nodes by pathto.
-	nodes := make([]string, 0, len(pathto))
-	for k := range pathto {
-		nodes = append(nodes, k)
+// markCriticalPaths picks out the top -topk critical paths in the graph,
+// prints them out, and updates the graph edge attributes. This version
+// uses weighted edges, where the weight from X->Y is considered to be
+// the estimated build time of Y. Paths are extracted greedily one at a
+// time: after a path is painted, its interior edges are masked out and
+// the longest-path computation is rerun over the residual graph to find
+// the next one (Yen-style k-longest-path over a DAG).
+func markCriticalPaths(g *pgraph, nid string, included map[string]bool) ([][]pathsegment, error) {
+	masked := make(map[string]bool)
+	if *testsflag && !*testsincritpathflag {
+		for ek := range g.testEdges {
+			masked[ek] = true
+		}
 	}
-	sort.SliceStable(nodes,
-		func(i, j int) bool {
-			di := pathto[nodes[i]]
-			dj := pathto[nodes[j]]
-			return dj < di
-		})
 
-	// Print for debugging
-	verb(1, "nodes with pathto values:")
-	for k, v := range nodes {
-		pi, err := g.nidPkgSize(v)
+	// topsort must see the same masked set pathTo below uses: a -tests
+	// edge can introduce a cycle (a dependency's test imports reaching
+	// back to an ancestor), which would otherwise make the DFS-based
+	// topological order silently invalid rather than just absent.
+	listing, err := topsort(g, nid, masked)
+	if err != nil {
+		return nil, err
+	}
+
+	verb(2, "topsorted listing: %+v", listing)
+
+	k := *topkflag
+	if k < 1 {
+		k = 1
+	}
+
+	var paths [][]pathsegment
+	var rootTotal int
+	for idx := 1; idx <= k; idx++ {
+		pathto, err := pathTo(g, listing, masked)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		nlab := g.LookupNode(v).Label()
-		verb(1, "%d: %s sz=%d nf=%d pt=%d %s",
-			k, v, pi.Size, pi.NumFuncs, pathto[v], nlab)
-	}
 
-	// trace critical path
-	traceCritical(g, nid, nodes, included, pathto)
+		// Print for debugging
+		verb(1, "nodes with pathto values (path %d/%d):", idx, k)
+		nodes := make([]string, 0, len(pathto))
+		for n := range pathto {
+			nodes = append(nodes, n)
+		}
+		sort.SliceStable(nodes,
+			func(i, j int) bool {
+				return pathto[nodes[j]] < pathto[nodes[i]]
+			})
+		for p, v := range nodes {
+			pi, err := g.nidPkgSize(v)
+			if err != nil {
+				return nil, err
+			}
+			nlab := g.LookupNode(v).Label()
+			verb(1, "%d: %s sz=%d nf=%d pt=%d %s",
+				p, v, pi.Size, pi.NumFuncs, pathto[v], nlab)
+		}
 
-	return nil
+		cp, pathwt, err := traceCritical(g, nid, included, pathto, masked, idx, k, rootTotal)
+		if err != nil {
+			return nil, err
+		}
+		if idx == 1 {
+			rootTotal = pathwt
+		}
+		paths = append(paths, cp)
+
+		// Mask off this path's interior edges so the next iteration is
+		// forced to find a different longest path.
+		for p := 0; p < len(cp)-1; p++ {
+			masked[edgeKey(cp[p].nid, cp[p+1].nid)] = true
+		}
+	}
+
+	return paths, nil
 }
 
 func nidToId(g *pgraph, m map[string]bool) map[uint32]bool {
@@ -509,27 +1187,48 @@ func main() {
 		verb(2, "repohash: %s", repohash)
 	}
 
-	// Create cache
-	gcache, err = gocmdcache.Make(repohash, goroothash, *glcacheflag, *verbflag)
+	// Create cache. Every target, including the host-default one, gets
+	// its own cache subdirectory (see cacheDir) rather than folding the
+	// target into repohash/goroothash, so switching between targets
+	// doesn't make gcache treat another target's cache as stale and
+	// wipe it out.
+	//
+	// gocmdcache.Make only mkdirs one level deep, so make sure the
+	// parent (-glcache itself) exists before handing it a subdir.
+	if err := os.MkdirAll(*glcacheflag, 0777); err != nil {
+		log.Fatalf("error creating cache dir %s: %v", *glcacheflag, err)
+	}
+	gcache, err = gocmdcache.Make(repohash, goroothash, cacheDir(), *verbflag)
 	if err != nil {
 		log.Fatalf("error creating cache: %v", err)
 	}
 
 	// Construct dependency graph.
 	g := &pgraph{
-		Graph:  zgr.NewGraph(),
-		nodes:  make(map[string]int),
-		goroot: gr + "/src",
+		Graph:     zgr.NewGraph(),
+		nodes:     make(map[string]int),
+		goroot:    gr + "/src",
+		testEdges: make(map[string]bool),
+		standard:  make(map[string]bool),
 	}
 	if *polylineflag {
 		pla := map[string]string{"splines": "polyline"}
 		g.SetAttrs(pla)
 	}
-	nid, perr := populateNode(target, g)
+	var nid string
+	var perr error
+	switch *listmodeflag {
+	case "bulk":
+		nid, perr = populateGraphBulk(target, g)
+	case "per-pkg":
+		nid, perr = populateNode(target, g)
+	default:
+		usage(fmt.Sprintf("unknown -listmode %q (want 'bulk' or 'per-pkg')", *listmodeflag))
+	}
 	if perr != nil {
 		log.Fatal(perr)
 	}
-	if err := g.computeEdgeWeights(nid); err != nil {
+	if err := g.computeEdgeWeights(nid, target); err != nil {
 		log.Fatal(perr)
 	}
 	fmt.Printf("... creating DOT file %s\n", *dotoutflag)
@@ -543,11 +1242,26 @@ func main() {
 		}
 	}()
 	included := make(map[string]bool)
-	if err := markCriticalPaths(g, nid, included); err != nil {
+	paths, err := markCriticalPaths(g, nid, included)
+	if err != nil {
 		log.Fatal(err)
 	}
 	if err := g.Write(outf, nidToId(g, included)); err != nil {
 		log.Fatal(err)
 	}
+	if *jsonoutflag != "" {
+		fmt.Printf("... creating JSON file %s\n", *jsonoutflag)
+		jsonf, err := os.OpenFile(*jsonoutflag, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := g.WriteJSON(jsonf, included, paths); err != nil {
+			jsonf.Close()
+			log.Fatal(err)
+		}
+		if err := jsonf.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	verb(1, "graph:\n%s", g.String())
 }